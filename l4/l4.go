@@ -0,0 +1,291 @@
+// Package l4 implements raw TCP/UDP load balancing, forwarding bytes
+// straight through to a backend instead of terminating HTTP the way the l7
+// package does. It's meant for listeners fronting non-HTTP protocols, or
+// HTTP(S) traffic a caller would rather pass through untouched.
+package l4
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Policy selects which backend a new TCP connection or UDP flow should be
+// forwarded to. It mirrors l7.Policy's idea of a pluggable selection
+// strategy, but works over plain backend addresses instead of Server/
+// *http.Request: a raw byte stream has no request to inspect and no
+// reverse-proxy wrapping each backend.
+type Policy interface {
+	Next(backends []string) string
+}
+
+// roundRobinPolicy cycles through backends in order.
+type roundRobinPolicy struct {
+	count uint64
+}
+
+// NewRoundRobinPolicy returns the default L4 policy: plain round-robin over
+// the configured backends.
+func NewRoundRobinPolicy() Policy { return &roundRobinPolicy{} }
+
+func (p *roundRobinPolicy) Next(backends []string) string {
+	if len(backends) == 0 {
+		return ""
+	}
+	idx := atomic.AddUint64(&p.count, 1) - 1
+	return backends[idx%uint64(len(backends))]
+}
+
+// Config describes one L4 listener.
+type Config struct {
+	// Network is "tcp" or "udp".
+	Network string
+
+	// ListenAddr is the local address to listen on, e.g. ":9000".
+	ListenAddr string
+
+	// Backends are the upstream "host:port" addresses to forward to.
+	Backends []string
+
+	// Policy picks a backend per connection (TCP) or per new flow (UDP).
+	// Defaults to round-robin if nil.
+	Policy Policy
+
+	// IdleTimeout closes a TCP connection (or forgets a UDP flow) after
+	// this long without traffic in either direction. Defaults to 5 minutes.
+	IdleTimeout time.Duration
+}
+
+func (c Config) policy() Policy {
+	if c.Policy != nil {
+		return c.Policy
+	}
+	return NewRoundRobinPolicy()
+}
+
+func (c Config) idleTimeout() time.Duration {
+	if c.IdleTimeout > 0 {
+		return c.IdleTimeout
+	}
+	return 5 * time.Minute
+}
+
+// Proxy runs a single L4 listener until Close is called.
+type Proxy struct {
+	cfg      Config
+	listener net.Listener
+	conn     net.PacketConn
+
+	// flowsMu guards flows, which startUDP populates and pumpUDPReplies
+	// prunes once a flow's reply pump exits, so the table only ever holds
+	// entries for flows that are actually still alive.
+	flowsMu sync.Mutex
+	flows   map[string]*flow
+}
+
+// NewProxy returns a Proxy for cfg. Call Start to actually begin listening.
+func NewProxy(cfg Config) *Proxy {
+	// Resolve the default once, so every connection shares one round-robin
+	// counter instead of each getting a fresh policy that starts at zero.
+	cfg.Policy = cfg.policy()
+	return &Proxy{cfg: cfg}
+}
+
+// Start opens the listener (TCP) or packet connection (UDP) and begins
+// forwarding traffic. It blocks until the listener is closed or a fatal
+// accept/read error occurs.
+func (p *Proxy) Start() error {
+	switch p.cfg.Network {
+	case "udp":
+		return p.startUDP()
+	default:
+		return p.startTCP()
+	}
+}
+
+// Close shuts down the listener/packet connection, unblocking Start.
+func (p *Proxy) Close() error {
+	if p.listener != nil {
+		return p.listener.Close()
+	}
+	if p.conn != nil {
+		return p.conn.Close()
+	}
+	return nil
+}
+
+func (p *Proxy) startTCP() error {
+	ln, err := net.Listen("tcp", p.cfg.ListenAddr)
+	if err != nil {
+		return err
+	}
+	p.listener = ln
+
+	for {
+		clientConn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go p.handleTCPConn(clientConn)
+	}
+}
+
+func (p *Proxy) handleTCPConn(clientConn net.Conn) {
+	defer clientConn.Close()
+
+	backend := p.cfg.policy().Next(p.cfg.Backends)
+	if backend == "" {
+		log.Printf("l4: no backends configured for %s", p.cfg.ListenAddr)
+		return
+	}
+
+	backendConn, err := net.Dial("tcp", backend)
+	if err != nil {
+		log.Printf("l4: dial backend %q: %v", backend, err)
+		return
+	}
+	defer backendConn.Close()
+
+	idle := p.cfg.idleTimeout()
+	done := make(chan struct{}, 2)
+	lastActive := time.Now().UnixNano()
+
+	copyWithIdle := func(dst, src net.Conn) {
+		buf := make([]byte, 32*1024)
+		for {
+			src.SetReadDeadline(time.Now().Add(idle))
+			n, err := src.Read(buf)
+			if n > 0 {
+				atomic.StoreInt64(&lastActive, time.Now().UnixNano())
+				if _, werr := dst.Write(buf[:n]); werr != nil {
+					break
+				}
+			}
+			if err != nil {
+				// A read timeout on this side only ends the connection once
+				// the other direction has been quiet for idle as well.
+				if ne, ok := err.(net.Error); ok && ne.Timeout() &&
+					time.Since(time.Unix(0, atomic.LoadInt64(&lastActive))) < idle {
+					continue
+				}
+				break
+			}
+		}
+		done <- struct{}{}
+	}
+
+	go copyWithIdle(backendConn, clientConn)
+	go copyWithIdle(clientConn, backendConn)
+	<-done
+}
+
+// flow is a UDP client<->backend pairing kept alive long enough to route the
+// backend's reply back to the client it came from, analogous to the
+// shuttle/UDP flow-table pattern.
+type flow struct {
+	backendConn net.Conn
+	lastActive  time.Time
+}
+
+func (p *Proxy) startUDP() error {
+	conn, err := net.ListenPacket("udp", p.cfg.ListenAddr)
+	if err != nil {
+		return err
+	}
+	p.conn = conn
+	p.flows = make(map[string]*flow)
+
+	buf := make([]byte, 64*1024)
+	idle := p.cfg.idleTimeout()
+
+	for {
+		n, clientAddr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+
+		key := clientAddr.String()
+
+		p.flowsMu.Lock()
+		f, ok := p.flows[key]
+		if !ok || time.Since(f.lastActive) > idle {
+			backend := p.cfg.policy().Next(p.cfg.Backends)
+			if backend == "" {
+				p.flowsMu.Unlock()
+				log.Printf("l4: no backends configured for %s", p.cfg.ListenAddr)
+				continue
+			}
+			backendConn, err := net.Dial("udp", backend)
+			if err != nil {
+				p.flowsMu.Unlock()
+				log.Printf("l4: dial backend %q: %v", backend, err)
+				continue
+			}
+			f = &flow{backendConn: backendConn}
+			p.flows[key] = f
+			go p.pumpUDPReplies(conn, clientAddr, key, f)
+		}
+		f.lastActive = time.Now()
+		p.flowsMu.Unlock()
+
+		if _, err := f.backendConn.Write(buf[:n]); err != nil {
+			log.Printf("l4: write to backend: %v", err)
+		}
+	}
+}
+
+// pumpUDPReplies copies datagrams from a single backend connection back to
+// the client that originated the flow, until the flow goes idle. It prunes
+// its own entry from the flow table on the way out, so an idle client's
+// flow doesn't linger in the table forever.
+func (p *Proxy) pumpUDPReplies(conn net.PacketConn, clientAddr net.Addr, key string, f *flow) {
+	buf := make([]byte, 64*1024)
+	idle := p.cfg.idleTimeout()
+
+	defer p.deleteFlow(key, f)
+
+	for {
+		f.backendConn.SetReadDeadline(time.Now().Add(idle))
+		n, err := f.backendConn.Read(buf)
+		p.flowsMu.Lock()
+		if err == nil {
+			f.lastActive = time.Now()
+		}
+		recent := time.Since(f.lastActive) < idle
+		p.flowsMu.Unlock()
+		if err != nil {
+			// A quiet backend only ends the flow once the client has been
+			// quiet for idle as well.
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && recent {
+				continue
+			}
+			f.backendConn.Close()
+			return
+		}
+		if _, err := conn.WriteTo(buf[:n], clientAddr); err != nil {
+			log.Printf("l4: write to client %s: %v", clientAddr, err)
+		}
+	}
+}
+
+// deleteFlow removes key's flow table entry once its reply pump exits, but
+// only if it's still f: startUDP may already have replaced this flow with a
+// fresh one under the same key by the time the old pump notices it's idle.
+func (p *Proxy) deleteFlow(key string, f *flow) {
+	p.flowsMu.Lock()
+	defer p.flowsMu.Unlock()
+	if p.flows[key] == f {
+		delete(p.flows, key)
+	}
+}
+
+// String is a small helper so Config values log cleanly.
+func (c Config) String() string {
+	return fmt.Sprintf("%s %s -> %v", c.Network, c.ListenAddr, c.Backends)
+}
+
+var _ io.Closer = (*Proxy)(nil)
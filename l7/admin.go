@@ -0,0 +1,115 @@
+package l7
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// AdminAPI exposes the dynamic server-pool operations (add/remove/list) over
+// a small JSON HTTP API. It's meant to be bound to its own port, separate
+// from the public listener.
+//
+// Endpoints:
+//
+//	GET    /admin/servers                 -> []ServerStatus
+//	POST   /admin/servers                 <- addServerRequest{address, weight}
+//	DELETE /admin/servers?address=<addr>  -> 204, or 404 if not registered
+//
+// DELETE takes the address as a query parameter rather than a path segment
+// (i.e. not DELETE /admin/servers/<addr>): backend addresses are themselves
+// URLs, and a URL embedded verbatim after a trailing path segment produces a
+// "//" that http.ServeMux's path cleaning collapses, redirecting the request
+// to a path that never matches any registered server.
+type AdminAPI struct {
+	lb       *LoadBalancer
+	hc       *HealthChecker
+	hcConfig HealthCheckConfig
+
+	// metricsHandler is nil unless SetMetricsHandler has been called, in
+	// which case it's mounted at /metrics. Kept as a plain http.Handler so
+	// this package doesn't need to depend on Prometheus to serve it.
+	metricsHandler http.Handler
+}
+
+// NewAdminAPI returns an AdminAPI wired to lb. Any server added through
+// POST /admin/servers is registered with hc using hcConfig, so hot-added
+// backends get the same active health checking as the ones the load
+// balancer started with.
+func NewAdminAPI(lb *LoadBalancer, hc *HealthChecker, hcConfig HealthCheckConfig) *AdminAPI {
+	return &AdminAPI{lb: lb, hc: hc, hcConfig: hcConfig}
+}
+
+// SetMetricsHandler mounts h at /metrics on the admin API. Passing nil
+// unmounts it.
+func (a *AdminAPI) SetMetricsHandler(h http.Handler) {
+	a.metricsHandler = h
+}
+
+// Handler returns the http.Handler to bind to the admin port.
+func (a *AdminAPI) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/servers", a.handleServers)
+	if a.metricsHandler != nil {
+		mux.Handle("/metrics", a.metricsHandler)
+	}
+	return mux
+}
+
+type addServerRequest struct {
+	Address string `json:"address"`
+	Weight  int    `json:"weight"`
+}
+
+// handleServers backs GET/POST/DELETE /admin/servers; see the AdminAPI doc
+// comment for the exact request/response shape of each.
+func (a *AdminAPI) handleServers(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		writeJSON(rw, http.StatusOK, a.lb.ListServers())
+
+	case http.MethodPost:
+		var body addServerRequest
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Address == "" {
+			http.Error(rw, "invalid request body", http.StatusBadRequest)
+			return
+		}
+		if body.Weight <= 0 {
+			body.Weight = 1
+		}
+
+		s := NewWeightedSimpleServer(body.Address, body.Weight)
+		a.lb.AddServer(s)
+		if a.hc != nil {
+			a.hc.Register(s, a.hcConfig)
+		}
+
+		writeJSON(rw, http.StatusCreated, ServerStatus{
+			Address:  s.Address(),
+			Weight:   s.Weight(),
+			Alive:    s.IsAlive(),
+			Counters: s.Counters(),
+		})
+
+	case http.MethodDelete:
+		addr := req.URL.Query().Get("address")
+		if addr == "" {
+			http.Error(rw, "missing address query parameter", http.StatusBadRequest)
+			return
+		}
+		if err := a.lb.RemoveServer(addr); err != nil {
+			http.Error(rw, err.Error(), http.StatusNotFound)
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+
+	default:
+		rw.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJSON(rw http.ResponseWriter, status int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(v)
+}
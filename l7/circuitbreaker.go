@@ -0,0 +1,163 @@
+package l7
+
+import (
+	"sync"
+	"time"
+)
+
+// CircuitState is one state in the standard closed -> open -> half-open
+// breaker state machine.
+type CircuitState int32
+
+const (
+	CircuitClosed CircuitState = iota
+	CircuitOpen
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// CircuitBreakerConfig tunes when a breaker trips and how long it stays open.
+type CircuitBreakerConfig struct {
+	// Window is how far back RecordResult calls count toward the error
+	// rate used to decide whether to trip.
+	Window time.Duration
+
+	// MinRequests is the minimum number of requests seen within Window
+	// before the breaker will consider tripping, so a cold start (or a
+	// quiet backend) with one failure doesn't immediately open it.
+	MinRequests int
+
+	// FailureRateThreshold trips the breaker once the fraction of failures
+	// within Window meets or exceeds this (0..1).
+	FailureRateThreshold float64
+
+	// Cooldown is how long the breaker stays Open before letting a single
+	// half-open probe request through.
+	Cooldown time.Duration
+}
+
+// DefaultCircuitBreakerConfig trips at a 50% failure rate over a 30s window
+// (once at least 10 requests have been seen), then cools down for 10s.
+func DefaultCircuitBreakerConfig() CircuitBreakerConfig {
+	return CircuitBreakerConfig{
+		Window:               30 * time.Second,
+		MinRequests:          10,
+		FailureRateThreshold: 0.5,
+		Cooldown:             10 * time.Second,
+	}
+}
+
+type outcome struct {
+	at      time.Time
+	success bool
+}
+
+// CircuitBreaker guards a single backend: once the failure rate within
+// Window crosses FailureRateThreshold it trips Open and short-circuits
+// requests to that backend for Cooldown, then lets one half-open probe
+// request through to decide whether to close again or re-open.
+type CircuitBreaker struct {
+	cfg CircuitBreakerConfig
+
+	mu               sync.Mutex
+	state            CircuitState
+	openedAt         time.Time
+	events           []outcome
+	halfOpenInFlight bool
+}
+
+// NewCircuitBreaker returns a breaker in the Closed state, configured by cfg.
+func NewCircuitBreaker(cfg CircuitBreakerConfig) *CircuitBreaker {
+	return &CircuitBreaker{cfg: cfg}
+}
+
+// Allow reports whether a new request may be sent to the backend this
+// breaker guards right now. While Open it refuses everything until Cooldown
+// has elapsed, at which point it admits exactly one half-open probe.
+func (cb *CircuitBreaker) Allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case CircuitOpen:
+		if time.Since(cb.openedAt) < cb.cfg.Cooldown {
+			return false
+		}
+		cb.state = CircuitHalfOpen
+		cb.halfOpenInFlight = true
+		return true
+	case CircuitHalfOpen:
+		if cb.halfOpenInFlight {
+			return false
+		}
+		cb.halfOpenInFlight = true
+		return true
+	default:
+		return true
+	}
+}
+
+// RecordResult feeds a single request's outcome into the breaker.
+func (cb *CircuitBreaker) RecordResult(success bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	now := time.Now()
+
+	if cb.state == CircuitHalfOpen {
+		cb.halfOpenInFlight = false
+		if success {
+			cb.state = CircuitClosed
+			cb.events = nil
+		} else {
+			cb.state = CircuitOpen
+			cb.openedAt = now
+		}
+		return
+	}
+
+	cb.events = append(cb.events, outcome{at: now, success: success})
+	cb.events = pruneOutcomes(cb.events, now.Add(-cb.cfg.Window))
+
+	if len(cb.events) < cb.cfg.MinRequests {
+		return
+	}
+
+	failures := 0
+	for _, e := range cb.events {
+		if !e.success {
+			failures++
+		}
+	}
+	if float64(failures)/float64(len(cb.events)) >= cb.cfg.FailureRateThreshold {
+		cb.state = CircuitOpen
+		cb.openedAt = now
+		cb.events = nil
+	}
+}
+
+func pruneOutcomes(events []outcome, cutoff time.Time) []outcome {
+	i := 0
+	for i < len(events) && events[i].at.Before(cutoff) {
+		i++
+	}
+	return events[i:]
+}
+
+// State reports the breaker's current state, for the health and admin
+// subsystems to surface.
+func (cb *CircuitBreaker) State() CircuitState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state
+}
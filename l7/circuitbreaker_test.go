@@ -0,0 +1,142 @@
+package l7
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerStaysClosedBelowMinRequests(t *testing.T) {
+	cb := NewCircuitBreaker(CircuitBreakerConfig{
+		Window:               time.Minute,
+		MinRequests:          10,
+		FailureRateThreshold: 0.5,
+		Cooldown:             time.Second,
+	})
+
+	for i := 0; i < 9; i++ {
+		cb.RecordResult(false)
+	}
+
+	if got := cb.State(); got != CircuitClosed {
+		t.Fatalf("state = %v, want %v with fewer than MinRequests seen", got, CircuitClosed)
+	}
+	if !cb.Allow() {
+		t.Fatal("Allow() = false while closed")
+	}
+}
+
+func TestCircuitBreakerTripsAtFailureRateThreshold(t *testing.T) {
+	cb := NewCircuitBreaker(CircuitBreakerConfig{
+		Window:               time.Minute,
+		MinRequests:          4,
+		FailureRateThreshold: 0.5,
+		Cooldown:             time.Second,
+	})
+
+	cb.RecordResult(true)
+	cb.RecordResult(false)
+	cb.RecordResult(false)
+	cb.RecordResult(false)
+
+	if got := cb.State(); got != CircuitOpen {
+		t.Fatalf("state = %v, want %v at 75%% failure rate", got, CircuitOpen)
+	}
+	if cb.Allow() {
+		t.Fatal("Allow() = true while open and within cooldown")
+	}
+}
+
+func TestCircuitBreakerHalfOpenAdmitsOneProbeAfterCooldown(t *testing.T) {
+	cb := NewCircuitBreaker(CircuitBreakerConfig{
+		Window:               time.Minute,
+		MinRequests:          1,
+		FailureRateThreshold: 0.5,
+		Cooldown:             10 * time.Millisecond,
+	})
+
+	cb.RecordResult(false)
+	if cb.State() != CircuitOpen {
+		t.Fatalf("state = %v, want %v after a failing request", cb.State(), CircuitOpen)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	if !cb.Allow() {
+		t.Fatal("Allow() = false after cooldown elapsed, want true for the half-open probe")
+	}
+	if cb.Allow() {
+		t.Fatal("Allow() = true for a second concurrent half-open probe, want false")
+	}
+}
+
+func TestCircuitBreakerHalfOpenClosesOnSuccess(t *testing.T) {
+	cb := NewCircuitBreaker(CircuitBreakerConfig{
+		Window:               time.Minute,
+		MinRequests:          1,
+		FailureRateThreshold: 0.5,
+		Cooldown:             10 * time.Millisecond,
+	})
+
+	cb.RecordResult(false)
+	time.Sleep(20 * time.Millisecond)
+	if !cb.Allow() {
+		t.Fatal("Allow() = false for the half-open probe")
+	}
+
+	cb.RecordResult(true)
+
+	if got := cb.State(); got != CircuitClosed {
+		t.Fatalf("state = %v, want %v after a successful half-open probe", got, CircuitClosed)
+	}
+}
+
+func TestCircuitBreakerHalfOpenReopensOnFailure(t *testing.T) {
+	cb := NewCircuitBreaker(CircuitBreakerConfig{
+		Window:               time.Minute,
+		MinRequests:          1,
+		FailureRateThreshold: 0.5,
+		Cooldown:             10 * time.Millisecond,
+	})
+
+	cb.RecordResult(false)
+	time.Sleep(20 * time.Millisecond)
+	if !cb.Allow() {
+		t.Fatal("Allow() = false for the half-open probe")
+	}
+
+	cb.RecordResult(false)
+
+	if got := cb.State(); got != CircuitOpen {
+		t.Fatalf("state = %v, want %v after a failing half-open probe", got, CircuitOpen)
+	}
+	if cb.Allow() {
+		t.Fatal("Allow() = true immediately after reopening, want false within cooldown")
+	}
+}
+
+func TestCircuitBreakerPrunesOutcomesOutsideWindow(t *testing.T) {
+	cb := NewCircuitBreaker(CircuitBreakerConfig{
+		Window:               10 * time.Millisecond,
+		MinRequests:          2,
+		FailureRateThreshold: 0.9,
+		Cooldown:             time.Second,
+	})
+
+	cb.RecordResult(false)
+	time.Sleep(20 * time.Millisecond)
+
+	// The failure above has aged out of the window by the time this one is
+	// recorded, so it shouldn't count toward MinRequests and the breaker
+	// should still be below threshold with only one fresh event.
+	cb.RecordResult(false)
+	if got := cb.State(); got != CircuitClosed {
+		t.Fatalf("state = %v, want %v with only one event inside the window", got, CircuitClosed)
+	}
+
+	// A second fresh failure brings the in-window count to MinRequests and
+	// crosses the threshold, confirming pruning didn't also drop this one.
+	cb.RecordResult(false)
+	if got := cb.State(); got != CircuitOpen {
+		t.Fatalf("state = %v, want %v once two fresh failures are in the window", got, CircuitOpen)
+	}
+}
@@ -0,0 +1,38 @@
+package l7
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// probeGRPC calls the standard grpc.health.v1.Health/Check RPC against addr
+// and reports whether the backend reported SERVING for cfg.Service.
+func probeGRPC(addr string, cfg HealthCheckConfig) bool {
+	target, err := tcpHostPort(addr)
+	if err != nil {
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+
+	conn, err := grpc.DialContext(ctx, target,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithBlock(),
+	)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{
+		Service: cfg.Service,
+	})
+	if err != nil {
+		return false
+	}
+	return resp.GetStatus() == healthpb.HealthCheckResponse_SERVING
+}
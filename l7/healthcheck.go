@@ -0,0 +1,301 @@
+package l7
+
+import (
+	"context"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"sync"
+	"time"
+)
+
+// Protocol selects which kind of active probe a HealthChecker runs against a
+// backend.
+type Protocol string
+
+const (
+	ProtocolHTTP Protocol = "http"
+	ProtocolTCP  Protocol = "tcp"
+	ProtocolGRPC Protocol = "grpc"
+)
+
+// defaultMaxConsecutiveFailures is how many proxy failures in a row
+// (5xx responses or transport errors) a server can have before it is pulled
+// out of rotation by the passive check.
+const defaultMaxConsecutiveFailures = 3
+
+// HealthCheckConfig describes how a single backend should be probed. The
+// shape mirrors Traefik's healthcheck package: a scheme+hostname+port+path
+// triple for HTTP probes, plus headers and redirect handling, with Interval
+// and Timeout controlling the probe loop.
+type HealthCheckConfig struct {
+	Protocol Protocol
+
+	Interval time.Duration
+	Timeout  time.Duration
+
+	// HTTP probe settings.
+	Scheme           string
+	Hostname         string
+	Port             string
+	Path             string
+	Headers          http.Header
+	ExpectedStatuses []int
+	FollowRedirects  bool
+
+	// GRPC probe settings.
+	Service string
+}
+
+// DefaultHealthCheckConfig returns an HTTP health check hitting "/" every 10s
+// with a 2s timeout, accepting only a 200 response.
+func DefaultHealthCheckConfig() HealthCheckConfig {
+	return HealthCheckConfig{
+		Protocol:         ProtocolHTTP,
+		Interval:         10 * time.Second,
+		Timeout:          2 * time.Second,
+		Scheme:           "http",
+		Path:             "/",
+		ExpectedStatuses: []int{http.StatusOK},
+		FollowRedirects:  false,
+	}
+}
+
+func (c HealthCheckConfig) expectStatus(code int) bool {
+	if len(c.ExpectedStatuses) == 0 {
+		return code >= 200 && code < 300
+	}
+	for _, want := range c.ExpectedStatuses {
+		if want == code {
+			return true
+		}
+	}
+	return false
+}
+
+// registration pairs a Server with the config its probes should run under.
+type registration struct {
+	server Server
+	config HealthCheckConfig
+	ticker *time.Ticker
+}
+
+// HealthChecker runs active probes against a set of registered servers on
+// their own per-server interval. A server pulled out of rotation by the
+// passive check returns only once one of these periodic probes passes again;
+// Probe runs a single check on demand.
+type HealthChecker struct {
+	client *http.Client
+
+	mu      sync.Mutex
+	regs    []*registration
+	started bool
+	stopCh  chan struct{}
+
+	// metrics is nil unless SetMetrics has been called.
+	metrics MetricsRecorder
+}
+
+// NewHealthChecker returns a HealthChecker ready to have servers registered
+// with it.
+func NewHealthChecker() *HealthChecker {
+	return &HealthChecker{
+		client: &http.Client{},
+		stopCh: make(chan struct{}),
+	}
+}
+
+// Register adds a server to the check loop using cfg. Before Start it only
+// records the server, and Start probes it along with the rest; after Start
+// it probes the server right away and starts its loop.
+func (hc *HealthChecker) Register(s Server, cfg HealthCheckConfig) {
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultHealthCheckConfig().Interval
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultHealthCheckConfig().Timeout
+	}
+
+	hc.mu.Lock()
+	reg := &registration{server: s, config: cfg}
+	hc.regs = append(hc.regs, reg)
+	started := hc.started
+	hc.mu.Unlock()
+
+	// If the checker is already running (a server registered after Start,
+	// e.g. via the admin API's hot-add endpoint), bring this one up to
+	// speed immediately instead of waiting for a caller to notice and call
+	// Start again.
+	if started {
+		hc.startReg(reg)
+	}
+}
+
+// Start runs an initial probe of every registered server synchronously (so
+// callers see accurate state as soon as Start returns) and then kicks off a
+// goroutine per server that re-probes on its configured Interval.
+func (hc *HealthChecker) Start() {
+	hc.mu.Lock()
+	hc.started = true
+	regs := append([]*registration(nil), hc.regs...)
+	hc.mu.Unlock()
+
+	for _, reg := range regs {
+		hc.startReg(reg)
+	}
+}
+
+func (hc *HealthChecker) startReg(reg *registration) {
+	hc.setAlive(reg, hc.Probe(reg.server, reg.config))
+	reg.ticker = time.NewTicker(reg.config.Interval)
+	go hc.run(reg)
+}
+
+func (hc *HealthChecker) run(reg *registration) {
+	for {
+		select {
+		case <-reg.ticker.C:
+			hc.setAlive(reg, hc.Probe(reg.server, reg.config))
+		case <-hc.stopCh:
+			reg.ticker.Stop()
+			return
+		}
+	}
+}
+
+// setAlive applies a probe result to reg.server and reports it to
+// hc.metrics, if set.
+func (hc *HealthChecker) setAlive(reg *registration, alive bool) {
+	reg.server.SetAlive(alive)
+	if hc.metrics != nil {
+		hc.metrics.SetServerUp(reg.server.Address(), alive)
+	}
+}
+
+// SetMetrics wires m into the probe loop so every health check result is
+// reported to it. Passing nil disables instrumentation.
+func (hc *HealthChecker) SetMetrics(m MetricsRecorder) {
+	hc.metrics = m
+}
+
+// Stop halts every probe goroutine started by Start.
+func (hc *HealthChecker) Stop() {
+	close(hc.stopCh)
+}
+
+// Probe runs a single, synchronous active check against s using cfg and
+// reports whether it should be considered alive. The probe loop calls it on
+// every tick; serveProxy does not call it.
+func (hc *HealthChecker) Probe(s Server, cfg HealthCheckConfig) bool {
+	switch cfg.Protocol {
+	case ProtocolTCP:
+		return probeTCP(s.Address(), cfg.Timeout)
+	case ProtocolGRPC:
+		return probeGRPC(s.Address(), cfg)
+	default:
+		return hc.probeHTTP(s.Address(), cfg)
+	}
+}
+
+func (hc *HealthChecker) probeHTTP(addr string, cfg HealthCheckConfig) bool {
+	target, err := healthCheckURL(addr, cfg)
+	if err != nil {
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return false
+	}
+	for k, vs := range cfg.Headers {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	if cfg.Hostname != "" {
+		req.Host = cfg.Hostname
+	}
+
+	client := hc.client
+	if !cfg.FollowRedirects {
+		client = &http.Client{
+			Timeout: cfg.Timeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+
+	return cfg.expectStatus(resp.StatusCode)
+}
+
+// healthCheckURL builds the probe URL for a backend, letting cfg override
+// the scheme/hostname/port of the backend's own address and falling back to
+// parsing addr when it isn't set.
+func healthCheckURL(addr string, cfg HealthCheckConfig) (string, error) {
+	u, err := neturl.Parse(addr)
+	if err != nil {
+		return "", err
+	}
+	if cfg.Scheme != "" {
+		u.Scheme = cfg.Scheme
+	}
+	host := u.Hostname()
+	if cfg.Hostname != "" {
+		host = cfg.Hostname
+	}
+	port := u.Port()
+	if cfg.Port != "" {
+		port = cfg.Port
+	}
+	if port != "" {
+		u.Host = net.JoinHostPort(host, port)
+	} else {
+		u.Host = host
+	}
+	if cfg.Path != "" {
+		u.Path = cfg.Path
+	}
+	return u.String(), nil
+}
+
+// probeTCP reports whether a raw TCP connection to addr's host:port can be
+// established within timeout. This is the L4 probe used for backends that
+// don't speak HTTP.
+func probeTCP(addr string, timeout time.Duration) bool {
+	host, err := tcpHostPort(addr)
+	if err != nil {
+		return false
+	}
+	conn, err := net.DialTimeout("tcp", host, timeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+func tcpHostPort(addr string) (string, error) {
+	u, err := neturl.Parse(addr)
+	if err != nil {
+		return "", err
+	}
+	port := u.Port()
+	if port == "" {
+		if u.Scheme == "https" {
+			port = "443"
+		} else {
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port), nil
+}
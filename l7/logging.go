@@ -0,0 +1,23 @@
+package l7
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"os"
+)
+
+// logger emits one JSON line per proxy attempt (request ID, backend,
+// latency, status, attempt number), so a retried request logs one line per
+// backend tried, replacing the fmt.Printf calls this package used to make.
+var logger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+// newRequestID returns a random 16-byte hex string, used to tag a request
+// that didn't arrive with its own X-Request-Id.
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
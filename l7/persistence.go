@@ -0,0 +1,180 @@
+package l7
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PersistenceMode selects how (if at all) the Persistence subsystem sticks a
+// client to the same backend across requests.
+type PersistenceMode string
+
+const (
+	PersistenceNone   PersistenceMode = "none"
+	PersistenceSource PersistenceMode = "source"
+	PersistenceCookie PersistenceMode = "cookie"
+)
+
+// affinityCookieName is the cookie Persistence sets in PersistenceCookie
+// mode.
+const affinityCookieName = "LB_AFFINITY"
+
+type affinityEntry struct {
+	addr    string
+	expires time.Time
+}
+
+// Persistence makes repeat requests from the same client stick to the same
+// backend, composing with whatever Policy picked that backend the first
+// time: serveProxy only consults the Policy when Persistence has no sticky
+// mapping (or the mapped backend is unhealthy), and records the Policy's
+// pick for next time.
+type Persistence struct {
+	mode    PersistenceMode
+	ttl     time.Duration
+	hmacKey []byte
+
+	// trustedProxies lists RemoteAddr hosts allowed to set X-Forwarded-For;
+	// an empty set means X-Forwarded-For is never trusted.
+	trustedProxies map[string]struct{}
+
+	mu    sync.RWMutex
+	cache map[string]affinityEntry
+}
+
+// NewPersistence builds a Persistence in the given mode. hmacKey is only
+// used in PersistenceCookie mode, to sign the chosen backend's address so
+// clients can't forge affinity to an arbitrary server.
+func NewPersistence(mode PersistenceMode, ttl time.Duration, hmacKey []byte, trustedProxies []string) *Persistence {
+	trusted := make(map[string]struct{}, len(trustedProxies))
+	for _, addr := range trustedProxies {
+		trusted[addr] = struct{}{}
+	}
+	return &Persistence{
+		mode:           mode,
+		ttl:            ttl,
+		hmacKey:        hmacKey,
+		trustedProxies: trusted,
+		cache:          make(map[string]affinityEntry),
+	}
+}
+
+// Lookup returns the server a previous request from this client was bound
+// to, if any, provided that server is still present and alive in servers.
+// It returns nil if there's no sticky mapping, the mapping expired, or the
+// mapped server fell out of rotation - the caller should fall back to its
+// Policy in that case.
+func (p *Persistence) Lookup(req *http.Request, servers []Server) Server {
+	var addr string
+	switch p.mode {
+	case PersistenceSource:
+		addr = p.lookupSource(req)
+	case PersistenceCookie:
+		addr = p.lookupCookie(req)
+	default:
+		return nil
+	}
+	if addr == "" {
+		return nil
+	}
+	for _, s := range servers {
+		if s.Address() == addr && s.IsAlive() {
+			return s
+		}
+	}
+	return nil
+}
+
+// Bind records that req's client should stick to server from now on: cached
+// with a TTL in PersistenceSource mode, or set as a signed cookie on rw in
+// PersistenceCookie mode. It is a no-op in PersistenceNone mode.
+func (p *Persistence) Bind(rw http.ResponseWriter, req *http.Request, server Server) {
+	switch p.mode {
+	case PersistenceSource:
+		p.mu.Lock()
+		p.cache[p.sourceKey(req)] = affinityEntry{addr: server.Address(), expires: time.Now().Add(p.ttl)}
+		p.mu.Unlock()
+	case PersistenceCookie:
+		http.SetCookie(rw, &http.Cookie{
+			Name:     affinityCookieName,
+			Value:    signAffinity(server.Address(), p.hmacKey),
+			Path:     "/",
+			MaxAge:   int(p.ttl.Seconds()),
+			HttpOnly: true,
+		})
+	}
+}
+
+func (p *Persistence) lookupSource(req *http.Request) string {
+	p.mu.RLock()
+	entry, ok := p.cache[p.sourceKey(req)]
+	p.mu.RUnlock()
+	if !ok || time.Now().After(entry.expires) {
+		return ""
+	}
+	return entry.addr
+}
+
+func (p *Persistence) lookupCookie(req *http.Request) string {
+	c, err := req.Cookie(affinityCookieName)
+	if err != nil {
+		return ""
+	}
+	addr, ok := verifyAffinity(c.Value, p.hmacKey)
+	if !ok {
+		return ""
+	}
+	return addr
+}
+
+// sourceKey returns the address source-address affinity hashes: the first
+// X-Forwarded-For hop if RemoteAddr is a trusted proxy, otherwise
+// RemoteAddr's host itself.
+func (p *Persistence) sourceKey(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	if _, trusted := p.trustedProxies[host]; trusted {
+		if fwd := req.Header.Get("X-Forwarded-For"); fwd != "" {
+			return strings.TrimSpace(strings.Split(fwd, ",")[0])
+		}
+	}
+	return host
+}
+
+// signAffinity encodes addr and an HMAC-SHA256 of addr, separated by a dot,
+// so verifyAffinity can detect a tampered cookie.
+func signAffinity(addr string, key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(addr))
+	sig := mac.Sum(nil)
+	return base64.RawURLEncoding.EncodeToString([]byte(addr)) + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func verifyAffinity(value string, key []byte) (string, bool) {
+	parts := strings.SplitN(value, ".", 2)
+	if len(parts) != 2 {
+		return "", false
+	}
+	addrBytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", false
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(addrBytes)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return "", false
+	}
+	return string(addrBytes), true
+}
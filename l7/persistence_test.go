@@ -0,0 +1,68 @@
+package l7
+
+import "testing"
+
+func TestSignVerifyAffinityRoundTrip(t *testing.T) {
+	key := []byte("test-hmac-key")
+
+	token := signAffinity("https://backend-1", key)
+
+	addr, ok := verifyAffinity(token, key)
+	if !ok {
+		t.Fatalf("verifyAffinity(%q) = false, want true for a freshly signed token", token)
+	}
+	if addr != "https://backend-1" {
+		t.Fatalf("verifyAffinity(%q) = %q, want %q", token, addr, "https://backend-1")
+	}
+}
+
+func TestVerifyAffinityRejectsTamperedAddress(t *testing.T) {
+	key := []byte("test-hmac-key")
+	token := signAffinity("https://backend-1", key)
+
+	// Splice another address's encoded bytes onto backend-1's signature, as
+	// a client forging affinity to an arbitrary server would.
+	if _, ok := verifyAffinity(forgeToken(token, key), key); ok {
+		t.Fatal("verifyAffinity accepted a token with a mismatched signature")
+	}
+}
+
+func TestVerifyAffinityRejectsWrongKey(t *testing.T) {
+	token := signAffinity("https://backend-1", []byte("key-a"))
+
+	if _, ok := verifyAffinity(token, []byte("key-b")); ok {
+		t.Fatal("verifyAffinity accepted a token signed with a different key")
+	}
+}
+
+func TestVerifyAffinityRejectsMalformedToken(t *testing.T) {
+	cases := []string{
+		"",
+		"no-dot-separator",
+		"not base64!.also not base64!",
+	}
+	for _, c := range cases {
+		if _, ok := verifyAffinity(c, []byte("key")); ok {
+			t.Fatalf("verifyAffinity(%q) = true, want false for a malformed token", c)
+		}
+	}
+}
+
+// indexOfDot and forgeToken help TestVerifyAffinityRejectsTamperedAddress
+// build a token whose address half doesn't match its signature half without
+// depending on signAffinity's internal encoding.
+func indexOfDot(s string) int {
+	for i, c := range s {
+		if c == '.' {
+			return i
+		}
+	}
+	return -1
+}
+
+func forgeToken(validToken string, key []byte) string {
+	dot := indexOfDot(validToken)
+	otherToken := signAffinity("https://attacker-controlled", key)
+	otherDot := indexOfDot(otherToken)
+	return otherToken[:otherDot] + validToken[dot:]
+}
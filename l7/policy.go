@@ -0,0 +1,147 @@
+package l7
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Policy selects which backend should serve a given request out of a list of
+// currently-alive candidates. Implementations must be safe for concurrent
+// use, since serveProxy may call Next from many goroutines at once.
+type Policy interface {
+	Next(req *http.Request, servers []Server) Server
+}
+
+// RoundRobinPolicy cycles through servers in order. This is the load
+// balancer's original behavior, now expressed as a Policy.
+type RoundRobinPolicy struct {
+	count uint64
+}
+
+func NewRoundRobinPolicy() *RoundRobinPolicy { return &RoundRobinPolicy{} }
+
+func (p *RoundRobinPolicy) Next(req *http.Request, servers []Server) Server {
+	if len(servers) == 0 {
+		return nil
+	}
+	idx := atomic.AddUint64(&p.count, 1) - 1
+	return servers[idx%uint64(len(servers))]
+}
+
+// RandomPolicy picks a uniformly random server out of the candidates.
+type RandomPolicy struct{}
+
+func NewRandomPolicy() *RandomPolicy { return &RandomPolicy{} }
+
+func (p *RandomPolicy) Next(req *http.Request, servers []Server) Server {
+	if len(servers) == 0 {
+		return nil
+	}
+	return servers[rand.Intn(len(servers))]
+}
+
+// LeastConnectionsPolicy sends each request to the server with the fewest
+// in-flight requests, as tracked by Server.ActiveConnections.
+type LeastConnectionsPolicy struct{}
+
+func NewLeastConnectionsPolicy() *LeastConnectionsPolicy { return &LeastConnectionsPolicy{} }
+
+func (p *LeastConnectionsPolicy) Next(req *http.Request, servers []Server) Server {
+	var best Server
+	var bestCount int32
+	for i, s := range servers {
+		c := s.ActiveConnections()
+		if i == 0 || c < bestCount {
+			best = s
+			bestCount = c
+		}
+	}
+	return best
+}
+
+// IPHashPolicy hashes the client's address so repeat requests from the same
+// client land on the same backend, giving cheap session affinity without
+// the bookkeeping of the cookie/source-affinity Persistence subsystem.
+type IPHashPolicy struct{}
+
+func NewIPHashPolicy() *IPHashPolicy { return &IPHashPolicy{} }
+
+func (p *IPHashPolicy) Next(req *http.Request, servers []Server) Server {
+	if len(servers) == 0 {
+		return nil
+	}
+	h := fnv.New32a()
+	h.Write([]byte(clientAddr(req)))
+	return servers[h.Sum32()%uint32(len(servers))]
+}
+
+// clientAddr returns the address IPHashPolicy hashes: the first hop of
+// X-Forwarded-For when present, otherwise the host part of req.RemoteAddr
+// (without the port, which changes from one client connection to the next).
+func clientAddr(req *http.Request) string {
+	if fwd := req.Header.Get("X-Forwarded-For"); fwd != "" {
+		return strings.TrimSpace(strings.Split(fwd, ",")[0])
+	}
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
+
+// weightedState is the per-server bookkeeping smooth weighted round-robin
+// needs between calls.
+type weightedState struct {
+	weight  int
+	current int
+}
+
+// WeightedRoundRobinPolicy implements the same smooth weighted round-robin
+// algorithm nginx uses: every pick bumps each candidate's current weight by
+// its configured weight, hands the request to whichever has the highest
+// current weight, then knocks that server's current weight down by the sum
+// of all weights. Over time this spreads requests proportionally to weight
+// without bursting all of them at the heaviest server in a row.
+type WeightedRoundRobinPolicy struct {
+	mu    sync.Mutex
+	state map[string]*weightedState
+}
+
+func NewWeightedRoundRobinPolicy() *WeightedRoundRobinPolicy {
+	return &WeightedRoundRobinPolicy{state: make(map[string]*weightedState)}
+}
+
+func (p *WeightedRoundRobinPolicy) Next(req *http.Request, servers []Server) Server {
+	if len(servers) == 0 {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	total := 0
+	var best Server
+	var bestState *weightedState
+
+	for _, s := range servers {
+		st, ok := p.state[s.Address()]
+		if !ok {
+			st = &weightedState{weight: s.Weight()}
+			p.state[s.Address()] = st
+		}
+		st.current += st.weight
+		total += st.weight
+
+		if bestState == nil || st.current > bestState.current {
+			best = s
+			bestState = st
+		}
+	}
+
+	bestState.current -= total
+	return best
+}
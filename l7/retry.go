@@ -0,0 +1,195 @@
+package l7
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+// RetryPolicy bounds how serveProxy retries a request against a different
+// backend after a failure.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of backends to try, including the
+	// first one. 1 disables retries.
+	MaxAttempts int
+
+	// PerAttemptTimeout bounds how long a single attempt may take before
+	// it's treated as a failure and the next backend is tried.
+	PerAttemptTimeout time.Duration
+
+	// RetryableStatusCodes are the upstream response codes worth retrying
+	// on a different backend. Network errors surface through
+	// proxy.ErrorHandler as a 502, so they are retried only when 502 is
+	// listed here (as it is in DefaultRetryPolicy).
+	RetryableStatusCodes map[int]bool
+}
+
+// DefaultRetryPolicy retries up to 3 backends total, 5s per attempt, on the
+// classic "upstream is struggling" status codes.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:       3,
+		PerAttemptTimeout: 5 * time.Second,
+		RetryableStatusCodes: map[int]bool{
+			http.StatusBadGateway:         true,
+			http.StatusServiceUnavailable: true,
+			http.StatusGatewayTimeout:     true,
+		},
+	}
+}
+
+func (p RetryPolicy) retryableStatus(code int) bool {
+	return p.RetryableStatusCodes[code]
+}
+
+// idempotentMethods are the HTTP methods safe to retry against a second
+// backend without risking a duplicated side effect.
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+}
+
+func isIdempotent(method string) bool {
+	return idempotentMethods[method]
+}
+
+// maxBufferedResponseBody bounds how much of a single attempt's response
+// responseRecorder will hold in memory. Past this point the response is
+// almost certainly a large or streaming success the original code would
+// never retry anyway, so the rest is streamed straight to the real client
+// instead of buffered, capping memory use per in-flight request.
+const maxBufferedResponseBody = 4 << 20 // 4MiB
+
+// responseRecorder buffers a single proxy attempt's response instead of
+// writing it straight to the client, so serveProxy can throw the attempt
+// away and retry against a different backend if it turns out to be
+// retryable. Once an attempt is accepted, its contents are copied into the
+// real http.ResponseWriter with flushTo. If the body grows past
+// maxBufferedResponseBody, it switches to passthrough mode and streams the
+// remainder directly to rw, giving up retryability for that attempt.
+type responseRecorder struct {
+	rw          http.ResponseWriter
+	header      http.Header
+	body        bytes.Buffer
+	statusCode  int
+	wroteHeader bool
+	passthrough bool
+}
+
+func newResponseRecorder(rw http.ResponseWriter) *responseRecorder {
+	return &responseRecorder{rw: rw, header: make(http.Header), statusCode: http.StatusOK}
+}
+
+func (r *responseRecorder) Header() http.Header { return r.header }
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if !r.wroteHeader {
+		r.WriteHeader(http.StatusOK)
+	}
+	if r.passthrough {
+		return r.rw.Write(b)
+	}
+	if r.body.Len()+len(b) > maxBufferedResponseBody {
+		r.switchToPassthrough()
+		return r.rw.Write(b)
+	}
+	return r.body.Write(b)
+}
+
+func (r *responseRecorder) WriteHeader(code int) {
+	if r.wroteHeader {
+		return
+	}
+	r.statusCode = code
+	r.wroteHeader = true
+}
+
+// switchToPassthrough flushes everything buffered so far straight to the
+// real client and marks this attempt as no longer retryable. Called once a
+// response body crosses maxBufferedResponseBody.
+func (r *responseRecorder) switchToPassthrough() {
+	r.passthrough = true
+	dst := r.rw.Header()
+	for k, vs := range r.header {
+		dst[k] = vs
+	}
+	r.rw.WriteHeader(r.statusCode)
+	r.rw.Write(r.body.Bytes())
+	r.body.Reset()
+}
+
+// flushTo copies the recorded response into rw. It's a no-op once this
+// attempt has switched to passthrough mode, since that already wrote
+// straight to rw as the bytes came in.
+func (r *responseRecorder) flushTo(rw http.ResponseWriter) {
+	if r.passthrough {
+		return
+	}
+	dst := rw.Header()
+	for k, vs := range r.header {
+		dst[k] = vs
+	}
+	rw.WriteHeader(r.statusCode)
+	rw.Write(r.body.Bytes())
+}
+
+// withAttemptTimeout returns a copy of req whose context is cancelled after
+// timeout, plus the cancel func the caller must invoke once the attempt
+// finishes.
+func withAttemptTimeout(req *http.Request, timeout time.Duration) (*http.Request, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	return req.WithContext(ctx), cancel
+}
+
+// maxBufferedRequestBody bounds how much of a request body bufferRequestBody
+// will hold in memory, mirroring maxBufferedResponseBody on the response
+// side: a client's upload shouldn't be able to exhaust memory just because
+// its method happens to be retryable.
+const maxBufferedRequestBody = 4 << 20 // 4MiB
+
+// errRequestBodyTooLarge is returned by bufferRequestBody when req's body
+// exceeds maxBufferedRequestBody.
+var errRequestBodyTooLarge = errors.New("request body exceeds maxBufferedRequestBody")
+
+// bufferRequestBody reads req's body into memory once, up front, so a
+// retried request can replay it from a fresh reader on every attempt: the
+// first attempt's RoundTrip drains req.Body to EOF, so without this a retry
+// against a second backend would send an empty (or length-mismatched) body.
+// It returns nil if req has no body, and errRequestBodyTooLarge if the body
+// exceeds maxBufferedRequestBody. Callers should only buffer requests that
+// might actually be retried; anything else should stream straight through.
+func bufferRequestBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	defer req.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxBufferedRequestBody+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxBufferedRequestBody {
+		return nil, errRequestBodyTooLarge
+	}
+	return body, nil
+}
+
+// withAttemptBody points attemptReq's body at a fresh reader over body, so
+// each retry attempt gets its own unread copy instead of sharing the
+// previous attempt's drained one. A nil body is a no-op.
+func withAttemptBody(attemptReq *http.Request, body []byte) {
+	if body == nil {
+		return
+	}
+	attemptReq.ContentLength = int64(len(body))
+	attemptReq.Body = io.NopCloser(bytes.NewReader(body))
+	attemptReq.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+}
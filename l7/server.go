@@ -0,0 +1,576 @@
+// Package l7 implements the original HTTP(S) reverse-proxy load balancer:
+// Server/LoadBalancer, the pluggable Policy/Persistence layers, active and
+// passive health checking, and the dynamic-pool admin API. The l4 package
+// next to this one covers raw TCP/UDP forwarding instead.
+package l7
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Server is an interface that will be implemented by the simpleServer struct
+// it will help us to create a slice of servers that we want to load balance
+// and then we will call the Serve function on the server that we want to serve the request to
+type Server interface {
+	Address() string
+
+	IsAlive() bool
+
+	// SetAlive updates the server's health state. It is called by the
+	// HealthChecker after an active probe and by the passive-check hooks
+	// wired up in NewSimpleServer.
+	SetAlive(alive bool)
+
+	// Weight is this server's relative share of traffic under
+	// WeightedRoundRobinPolicy. Servers with no explicit weight default to 1.
+	Weight() int
+
+	// ActiveConnections reports how many requests are currently being served
+	// by this backend, for LeastConnectionsPolicy.
+	ActiveConnections() int32
+
+	// IncConnections and DecConnections are called by serveProxy around
+	// Serve to keep ActiveConnections accurate.
+	IncConnections()
+	DecConnections()
+
+	// AllowRequest reports whether this server's circuit breaker will let a
+	// new request through right now.
+	AllowRequest() bool
+
+	// RecordResult feeds a request's outcome (as judged by serveProxy) into
+	// the circuit breaker and the failure/latency counters.
+	RecordResult(success bool, latency time.Duration)
+
+	// Counters returns a snapshot of this server's failure/latency
+	// counters, for the health and admin subsystems to surface.
+	Counters() ServerCounters
+
+	Serve(rw http.ResponseWriter, req *http.Request)
+}
+
+// MetricsRecorder lets an external package (e.g. observability) instrument
+// serveProxy and the HealthChecker without this package depending on a
+// particular metrics backend. A nil MetricsRecorder disables instrumentation
+// entirely, matching how persistence is wired.
+type MetricsRecorder interface {
+	// ObserveRequest records one completed proxy attempt against server.
+	ObserveRequest(server, method string, statusCode int, duration time.Duration)
+
+	// ObserveUpstreamError records an attempt that failed, tagged with a
+	// short reason ("5xx", "timeout", ...).
+	ObserveUpstreamError(server, reason string)
+
+	// SetActiveRequests reports a server's current in-flight request count.
+	SetActiveRequests(server string, n int32)
+
+	// SetServerUp reports a server's latest health-check result.
+	SetServerUp(server string, up bool)
+}
+
+// ServerCounters is the JSON-friendly snapshot of a backend's circuit
+// breaker and request counters.
+type ServerCounters struct {
+	TotalRequests uint64        `json:"total_requests"`
+	Failures      uint64        `json:"failures"`
+	LastLatency   time.Duration `json:"last_latency_ns"`
+	CircuitState  string        `json:"circuit_state"`
+}
+
+// simpleServer is a struct that will implement the Server interface
+type simpleServer struct {
+	addr  string
+	proxy *httputil.ReverseProxy
+
+	// alive is 1 when the backend is considered healthy and 0 otherwise.
+	// It starts at 1 so the server is usable before the first health check
+	// has had a chance to run.
+	alive int32
+
+	// consecutiveFails counts proxy errors/5xx responses in a row, as
+	// observed by the ModifyResponse/ErrorHandler hooks below. It resets on
+	// the first success and trips the server unhealthy once it reaches
+	// defaultMaxConsecutiveFailures.
+	consecutiveFails int32
+
+	// weight is this server's share under WeightedRoundRobinPolicy.
+	weight int32
+
+	// activeConnections is the number of requests currently in flight to
+	// this backend, maintained by IncConnections/DecConnections.
+	activeConnections int32
+
+	// breaker trips this backend out of the retry rotation once its error
+	// rate crosses the configured threshold.
+	breaker *CircuitBreaker
+
+	// totalRequests, failures and lastLatencyNs back Counters(); they're
+	// fed by RecordResult, which serveProxy calls once per attempt.
+	totalRequests uint64
+	failures      uint64
+	lastLatencyNs int64
+}
+
+func (s *simpleServer) Address() string { return s.addr }
+
+func (s *simpleServer) IsAlive() bool { return atomic.LoadInt32(&s.alive) == 1 }
+
+func (s *simpleServer) SetAlive(alive bool) {
+	if alive {
+		atomic.StoreInt32(&s.alive, 1)
+	} else {
+		atomic.StoreInt32(&s.alive, 0)
+	}
+}
+
+func (s *simpleServer) Weight() int { return int(atomic.LoadInt32(&s.weight)) }
+
+func (s *simpleServer) ActiveConnections() int32 { return atomic.LoadInt32(&s.activeConnections) }
+
+func (s *simpleServer) IncConnections() { atomic.AddInt32(&s.activeConnections, 1) }
+
+func (s *simpleServer) DecConnections() { atomic.AddInt32(&s.activeConnections, -1) }
+
+func (s *simpleServer) AllowRequest() bool { return s.breaker.Allow() }
+
+func (s *simpleServer) RecordResult(success bool, latency time.Duration) {
+	atomic.AddUint64(&s.totalRequests, 1)
+	if !success {
+		atomic.AddUint64(&s.failures, 1)
+	}
+	atomic.StoreInt64(&s.lastLatencyNs, int64(latency))
+	s.breaker.RecordResult(success)
+}
+
+func (s *simpleServer) Counters() ServerCounters {
+	return ServerCounters{
+		TotalRequests: atomic.LoadUint64(&s.totalRequests),
+		Failures:      atomic.LoadUint64(&s.failures),
+		LastLatency:   time.Duration(atomic.LoadInt64(&s.lastLatencyNs)),
+		CircuitState:  s.breaker.State().String(),
+	}
+}
+
+func (s *simpleServer) Serve(rw http.ResponseWriter, req *http.Request) {
+	// it will start the server on the address that we have passed in the newSimpleServer function
+	// s.proxy is getting the proxy that we have created in the newSimpleServer function
+	// then we are calling the ServeHTTP function on the proxy that we have created in the newSimpleServer function
+	// ServeHTTP  will serve the request to the server that we have passed in the newSimpleServer function
+	s.proxy.ServeHTTP(rw, req)
+}
+
+// recordSuccess clears the consecutive-failure count and, if the server had
+// been marked down by recordFailure, brings it back into rotation.
+func (s *simpleServer) recordSuccess() {
+	atomic.StoreInt32(&s.consecutiveFails, 0)
+	if !s.IsAlive() {
+		s.SetAlive(true)
+	}
+}
+
+// recordFailure bumps the consecutive-failure count and marks the server
+// unhealthy once it crosses defaultMaxConsecutiveFailures. A later passing
+// active probe from the HealthChecker is what brings it back.
+func (s *simpleServer) recordFailure() {
+	if atomic.AddInt32(&s.consecutiveFails, 1) >= defaultMaxConsecutiveFailures {
+		s.SetAlive(false)
+	}
+}
+
+// NewSimpleServer returns a Server that reverse-proxies to addr with the
+// default weight of 1.
+func NewSimpleServer(addr string) Server {
+	return NewWeightedSimpleServer(addr, 1)
+}
+
+// NewWeightedSimpleServer is like NewSimpleServer but lets the caller set a
+// relative weight for WeightedRoundRobinPolicy.
+func NewWeightedSimpleServer(addr string, weight int) Server {
+	serverUrl, err := url.Parse(addr)
+	handleErr(err)
+
+	proxy := httputil.NewSingleHostReverseProxy(serverUrl)
+	s := &simpleServer{
+		addr:    addr,
+		proxy:   proxy,
+		alive:   1,
+		weight:  int32(weight),
+		breaker: NewCircuitBreaker(DefaultCircuitBreakerConfig()),
+	}
+
+	// Passive health checking: a run of 5xx responses or transport errors
+	// pulls the backend out of rotation without waiting for the next active
+	// probe tick. ReverseProxy swallows backend errors unless ErrorHandler
+	// is set, so this is also what lets serveProxy's retry/circuit-breaker
+	// logic see a network failure as a request outcome at all: it writes a
+	// 502 to whichever ResponseWriter it was given (which, when called via
+	// a retry attempt, is a throwaway responseRecorder serveProxy inspects
+	// rather than the real client connection).
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if resp.StatusCode >= http.StatusInternalServerError {
+			s.recordFailure()
+		} else {
+			s.recordSuccess()
+		}
+		return nil
+	}
+	proxy.ErrorHandler = func(rw http.ResponseWriter, req *http.Request, err error) {
+		s.recordFailure()
+		http.Error(rw, "upstream error", http.StatusBadGateway)
+	}
+
+	return s
+}
+
+type LoadBalancer struct {
+	port   string
+	policy Policy
+
+	// mu guards servers so AddServer/RemoveServer can mutate the pool while
+	// serveProxy is reading it from other goroutines.
+	mu      sync.RWMutex
+	servers []Server
+
+	// persistence is nil unless SetPersistence has been called, which
+	// keeps the zero value behaving exactly like before Persistence
+	// existed.
+	persistence *Persistence
+
+	retryPolicy RetryPolicy
+
+	// metrics is nil unless SetMetrics has been called, which keeps the zero
+	// value behaving exactly like before observability existed.
+	metrics MetricsRecorder
+}
+
+func NewLoadBalancer(port string, policy Policy, servers []Server) *LoadBalancer {
+	return &LoadBalancer{
+		port:        port,
+		policy:      policy,
+		servers:     servers,
+		retryPolicy: DefaultRetryPolicy(),
+	}
+}
+
+// SetPersistence enables session persistence on lb. Passing nil disables it.
+func (lb *LoadBalancer) SetPersistence(p *Persistence) {
+	lb.persistence = p
+}
+
+// SetRetryPolicy overrides the default retry/timeout behavior serveProxy
+// uses when an attempt fails.
+func (lb *LoadBalancer) SetRetryPolicy(p RetryPolicy) {
+	lb.retryPolicy = p
+}
+
+// SetMetrics wires m into serveProxy so every proxy attempt is reported to
+// it. Passing nil disables instrumentation.
+func (lb *LoadBalancer) SetMetrics(m MetricsRecorder) {
+	lb.metrics = m
+}
+
+func handleErr(err error) {
+	if err != nil {
+		logger.Error("fatal error", "error", err)
+		os.Exit(1)
+	}
+}
+
+// candidateServers returns the subset of lb.servers currently reporting
+// healthy, minus anything in excluded (addresses serveProxy has already
+// tried this request).
+func (lb *LoadBalancer) candidateServers(excluded map[string]bool) []Server {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	candidates := make([]Server, 0, len(lb.servers))
+	for _, s := range lb.servers {
+		if s.IsAlive() && !excluded[s.Address()] {
+			candidates = append(candidates, s)
+		}
+	}
+	return candidates
+}
+
+// aliveServers returns every currently healthy server.
+func (lb *LoadBalancer) aliveServers() []Server {
+	return lb.candidateServers(nil)
+}
+
+// AddServer adds s to the pool. It takes effect on the very next request -
+// there is no separate "activate" step.
+func (lb *LoadBalancer) AddServer(s Server) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.servers = append(lb.servers, s)
+}
+
+// RemoveServer takes the server with the given address out of the pool. It
+// returns an error if no such server is registered.
+func (lb *LoadBalancer) RemoveServer(addr string) error {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	for i, s := range lb.servers {
+		if s.Address() == addr {
+			lb.servers = append(lb.servers[:i], lb.servers[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("no server registered with address %q", addr)
+}
+
+// ServerStatus is the JSON-friendly snapshot of a backend's state returned
+// by ListServers and the admin API.
+type ServerStatus struct {
+	Address           string         `json:"address"`
+	Weight            int            `json:"weight"`
+	ActiveConnections int32          `json:"active_connections"`
+	Alive             bool           `json:"alive"`
+	Counters          ServerCounters `json:"counters"`
+}
+
+// ListServers returns a snapshot of every server currently in the pool.
+func (lb *LoadBalancer) ListServers() []ServerStatus {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	statuses := make([]ServerStatus, len(lb.servers))
+	for i, s := range lb.servers {
+		statuses[i] = ServerStatus{
+			Address:           s.Address(),
+			Weight:            s.Weight(),
+			ActiveConnections: s.ActiveConnections(),
+			Alive:             s.IsAlive(),
+			Counters:          s.Counters(),
+		}
+	}
+	return statuses
+}
+
+// getNextAvailableServer hands the currently alive, non-excluded servers to
+// the configured Policy. It returns nil if none are left.
+func (lb *LoadBalancer) getNextAvailableServer(req *http.Request, excluded map[string]bool) Server {
+	return lb.policy.Next(req, lb.candidateServers(excluded))
+}
+
+// pickServer chooses the next backend to try: a Persistence sticky mapping,
+// if one exists and hasn't already been excluded this request, otherwise
+// whatever the Policy picks from the remaining candidates.
+func (lb *LoadBalancer) pickServer(req *http.Request, excluded map[string]bool) Server {
+	if lb.persistence != nil {
+		if s := lb.persistence.Lookup(req, lb.candidateServers(excluded)); s != nil {
+			return s
+		}
+	}
+	return lb.getNextAvailableServer(req, excluded)
+}
+
+// this function is called when a request is made to the load balancer. Each
+// attempt runs against a throwaway responseRecorder rather than the real
+// ResponseWriter, so a retryable failure can be thrown away and retried
+// against a different backend instead of having already streamed a partial
+// response to the client.
+func (lb *LoadBalancer) serveProxy(rw http.ResponseWriter, req *http.Request) {
+	requestID := req.Header.Get("X-Request-Id")
+	if requestID == "" {
+		requestID = newRequestID()
+	}
+	rw.Header().Set("X-Request-Id", requestID)
+
+	// Protocol-upgrade requests (WebSocket and friends) can't be replayed
+	// against a responseRecorder, which doesn't implement http.Hijacker, and
+	// they aren't meaningfully retryable anyway, so they bypass the
+	// retry/circuit-breaker machinery and go straight to a single backend.
+	if isUpgradeRequest(req) {
+		lb.serveUpgrade(rw, req)
+		return
+	}
+
+	excluded := make(map[string]bool)
+
+	maxAttempts := 1
+	if isIdempotent(req.Method) {
+		maxAttempts = lb.retryPolicy.MaxAttempts
+	}
+
+	// Only requests that might actually be retried are worth buffering: a
+	// single-attempt request streams its body straight through as before, so
+	// it neither pays for a wasted read nor risks an unbounded allocation on
+	// a method that will never replay it.
+	var bodyBytes []byte
+	if maxAttempts > 1 {
+		var err error
+		bodyBytes, err = bufferRequestBody(req)
+		if err != nil {
+			if errors.Is(err, errRequestBodyTooLarge) {
+				http.Error(rw, "request body too large to retry", http.StatusRequestEntityTooLarge)
+			} else {
+				http.Error(rw, "failed to read request body", http.StatusBadRequest)
+			}
+			return
+		}
+	}
+
+	var lastStatus int
+	attempt := 0
+	for attempt < maxAttempts {
+		targetServer := lb.pickServer(req, excluded)
+		if targetServer == nil {
+			break
+		}
+
+		if !targetServer.AllowRequest() {
+			// circuit open for this backend: skip it without spending any of
+			// the attempt budget, so a handful of simultaneously-tripped
+			// breakers can't starve a request of backends that are actually
+			// healthy and untried
+			excluded[targetServer.Address()] = true
+			continue
+		}
+		attempt++
+
+		attemptReq, cancel := withAttemptTimeout(req, lb.retryPolicy.PerAttemptTimeout)
+		withAttemptBody(attemptReq, bodyBytes)
+		rec := newResponseRecorder(rw)
+
+		targetServer.IncConnections()
+		lb.reportActive(targetServer)
+		start := time.Now()
+		targetServer.Serve(rec, attemptReq)
+		latency := time.Since(start)
+		targetServer.DecConnections()
+		lb.reportActive(targetServer)
+		cancel()
+
+		success := rec.statusCode < http.StatusInternalServerError
+		targetServer.RecordResult(success, latency)
+
+		logger.Info("proxied request",
+			"request_id", requestID,
+			"backend", targetServer.Address(),
+			"method", req.Method,
+			"status", rec.statusCode,
+			"latency_ms", latency.Milliseconds(),
+			"attempt", attempt,
+		)
+
+		if lb.metrics != nil {
+			lb.metrics.ObserveRequest(targetServer.Address(), req.Method, rec.statusCode, latency)
+			if !success {
+				lb.metrics.ObserveUpstreamError(targetServer.Address(), upstreamErrorReason(rec.statusCode))
+			}
+		}
+
+		retryable := !success && lb.retryPolicy.retryableStatus(rec.statusCode) && !rec.passthrough
+		if !retryable || attempt == maxAttempts {
+			if lb.persistence != nil {
+				lb.persistence.Bind(rw, req, targetServer)
+			}
+			rec.flushTo(rw)
+			return
+		}
+
+		lastStatus = rec.statusCode
+		excluded[targetServer.Address()] = true
+	}
+
+	if lastStatus != 0 {
+		http.Error(rw, "all retry attempts failed", lastStatus)
+		return
+	}
+	http.Error(rw, "no healthy backends available", http.StatusServiceUnavailable)
+}
+
+// isUpgradeRequest reports whether req is asking to switch protocols (e.g.
+// WebSocket), the same signal httputil.ReverseProxy itself uses to decide
+// whether to hijack the connection instead of proxying a normal response.
+func isUpgradeRequest(req *http.Request) bool {
+	if req.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, token := range strings.Split(req.Header.Get("Connection"), ",") {
+		if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+			return true
+		}
+	}
+	return false
+}
+
+// serveUpgrade proxies a protocol-upgrade request straight to a single
+// backend, with no retry or response buffering: rw is passed to Serve
+// unwrapped so the underlying ReverseProxy can hijack it as usual. The
+// backend's ModifyResponse/ErrorHandler hooks still drive passive health
+// checking as they do for a normal attempt. The circuit breaker is neither
+// consulted nor fed here, and the failure/latency counters are not updated,
+// since there is no AllowRequest or RecordResult call.
+func (lb *LoadBalancer) serveUpgrade(rw http.ResponseWriter, req *http.Request) {
+	targetServer := lb.pickServer(req, nil)
+	if targetServer == nil {
+		http.Error(rw, "no healthy backends available", http.StatusServiceUnavailable)
+		return
+	}
+
+	targetServer.IncConnections()
+	lb.reportActive(targetServer)
+	targetServer.Serve(rw, req)
+	targetServer.DecConnections()
+	lb.reportActive(targetServer)
+
+	if lb.persistence != nil {
+		lb.persistence.Bind(rw, req, targetServer)
+	}
+}
+
+// reportActive pushes s's current in-flight count to lb.metrics, if set.
+func (lb *LoadBalancer) reportActive(s Server) {
+	if lb.metrics != nil {
+		lb.metrics.SetActiveRequests(s.Address(), s.ActiveConnections())
+	}
+}
+
+// upstreamErrorReason buckets a failing status code into a short label for
+// the lb_upstream_errors_total reason tag.
+func upstreamErrorReason(statusCode int) string {
+	if statusCode == http.StatusGatewayTimeout {
+		return "timeout"
+	}
+	return "5xx"
+}
+
+// Port returns the port this load balancer was configured to listen on.
+func (lb *LoadBalancer) Port() string { return lb.port }
+
+// Handler returns the http.Handler that serves requests through this load
+// balancer, for callers (e.g. main) that want to own the http.Server/
+// ListenAndServe call themselves.
+func (lb *LoadBalancer) Handler() http.Handler {
+	return http.HandlerFunc(lb.serveProxy)
+}
+
+// PolicyFromName is the config-driven way to pick a Policy at startup, e.g.
+// via the LB_POLICY environment variable. Unrecognized or empty names fall
+// back to round-robin, preserving the original default behavior.
+func PolicyFromName(name string) Policy {
+	switch name {
+	case "weighted-round-robin":
+		return NewWeightedRoundRobinPolicy()
+	case "random":
+		return NewRandomPolicy()
+	case "least-connections":
+		return NewLeastConnectionsPolicy()
+	case "ip-hash":
+		return NewIPHashPolicy()
+	default:
+		return NewRoundRobinPolicy()
+	}
+}
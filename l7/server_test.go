@@ -0,0 +1,188 @@
+package l7
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTrippedTestServer returns a Server whose circuit breaker is already
+// open, for tests that need a backend serveProxy should skip without ever
+// dialing it. addr doesn't need to be reachable: AllowRequest() is checked
+// before serveProxy ever calls Serve on it.
+func newTrippedTestServer(t *testing.T, addr string) Server {
+	t.Helper()
+	u, err := url.Parse(addr)
+	if err != nil {
+		t.Fatalf("url.Parse(%q): %v", addr, err)
+	}
+	s := &simpleServer{
+		addr:  addr,
+		proxy: httputil.NewSingleHostReverseProxy(u),
+		alive: 1,
+		breaker: NewCircuitBreaker(CircuitBreakerConfig{
+			Window:               time.Minute,
+			MinRequests:          1,
+			FailureRateThreshold: 0.01,
+			Cooldown:             time.Minute,
+		}),
+	}
+	s.RecordResult(false, 0)
+	return s
+}
+
+func TestServeProxyRetriesWithFullRequestBody(t *testing.T) {
+	backend1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer backend1.Close()
+
+	var receivedBody []byte
+	backend2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedBody, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend2.Close()
+
+	lb := NewLoadBalancer(":0", NewRoundRobinPolicy(), []Server{
+		NewSimpleServer(backend1.URL),
+		NewSimpleServer(backend2.URL),
+	})
+
+	const body = "hello-world-request-body"
+	req := httptest.NewRequest(http.MethodPut, "/", strings.NewReader(body))
+	rw := httptest.NewRecorder()
+	lb.serveProxy(rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200 once the retry lands on the healthy backend", rw.Code)
+	}
+	if string(receivedBody) != body {
+		t.Fatalf("backend2 received body %q, want %q", receivedBody, body)
+	}
+}
+
+func TestServeProxySkipsTrippedBreakersWithoutSpendingAttempts(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer healthy.Close()
+
+	tripped1 := newTrippedTestServer(t, "http://127.0.0.1:1")
+	tripped2 := newTrippedTestServer(t, "http://127.0.0.1:2")
+
+	lb := NewLoadBalancer(":0", NewRoundRobinPolicy(), []Server{
+		tripped1,
+		tripped2,
+		NewSimpleServer(healthy.URL),
+	})
+	// MaxAttempts of 1 means the old code - which spent a budget slot on
+	// every breaker skip - would exhaust it on tripped1 alone and never
+	// reach the healthy backend.
+	lb.SetRetryPolicy(RetryPolicy{
+		MaxAttempts:          1,
+		PerAttemptTimeout:    time.Second,
+		RetryableStatusCodes: DefaultRetryPolicy().RetryableStatusCodes,
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	rw := httptest.NewRecorder()
+	lb.serveProxy(rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: the healthy backend should still be tried despite two tripped breakers ahead of it", rw.Code)
+	}
+}
+
+func TestServeProxyOversizedResponseBypassesRetry(t *testing.T) {
+	payload := bytes.Repeat([]byte("a"), maxBufferedResponseBody+4096)
+
+	backend1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write(payload)
+	}))
+	defer backend1.Close()
+
+	var backend2Hits int32
+	backend2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&backend2Hits, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend2.Close()
+
+	lb := NewLoadBalancer(":0", NewRoundRobinPolicy(), []Server{
+		NewSimpleServer(backend1.URL),
+		NewSimpleServer(backend2.URL),
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	rw := httptest.NewRecorder()
+	lb.serveProxy(rw, req)
+
+	// A 502 is normally retryable, but once the body crosses
+	// maxBufferedResponseBody serveProxy should have already streamed it
+	// straight to the client instead of throwing the attempt away.
+	if rw.Code != http.StatusBadGateway {
+		t.Fatalf("status = %d, want %d", rw.Code, http.StatusBadGateway)
+	}
+	if rw.Body.Len() != len(payload) {
+		t.Fatalf("client received %d bytes, want %d", rw.Body.Len(), len(payload))
+	}
+	if atomic.LoadInt32(&backend2Hits) != 0 {
+		t.Fatal("backend2 was hit, want the oversized response from backend1 to bypass retry entirely")
+	}
+}
+
+func TestServeProxyBypassesBufferingForUpgradeRequests(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "not hijackable", http.StatusInternalServerError)
+			return
+		}
+		conn, bufrw, err := hj.Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		bufrw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		bufrw.Flush()
+	}))
+	defer backend.Close()
+
+	lb := NewLoadBalancer(":0", NewRoundRobinPolicy(), []Server{NewSimpleServer(backend.URL)})
+	lbServer := httptest.NewServer(lb.Handler())
+	defer lbServer.Close()
+
+	conn, err := net.Dial("tcp", lbServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial load balancer: %v", err)
+	}
+	defer conn.Close()
+
+	request := "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n"
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatalf("write request: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	statusLine, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	// A load balancer that wrapped this in responseRecorder (which doesn't
+	// implement http.Hijacker) would surface this as a 502 instead.
+	if !strings.Contains(statusLine, "101") {
+		t.Fatalf("status line = %q, want a 101 Switching Protocols response", statusLine)
+	}
+}
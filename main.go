@@ -1,130 +1,134 @@
 package main
 
 import (
-	"fmt"
+	"log/slog"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
 	"os"
-)
-
-// Server is an interface that will be implemented by the simpleServer struct
-// it will help us to create a slice of servers that we want to load balance
-// and then we will call the Serve function on the server that we want to serve the request to
-type Server interface {
-	Address() string
+	"time"
 
-	IsAlive() bool
-
-	Serve(rw http.ResponseWriter, req *http.Request)
-}
+	"github.com/Horiodino/loadbalancer-/l4"
+	"github.com/Horiodino/loadbalancer-/l7"
+	"github.com/Horiodino/loadbalancer-/observability"
+)
 
-// simpleServer is a struct that will implement the Server interface
-type simpleServer struct {
-	addr  string
-	proxy *httputil.ReverseProxy
-}
+// logger emits one JSON line per startup/fatal event, replacing the
+// fmt.Printf calls this file used to make.
+var logger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
 
-func (s *simpleServer) Address() string { return s.addr }
+// ListenerMode selects whether a listener in Config runs as an L7 HTTP
+// reverse proxy or an L4 raw TCP/UDP forwarder.
+type ListenerMode string
 
-func (s *simpleServer) IsAlive() bool { return true }
+const (
+	ModeL7  ListenerMode = "l7"
+	ModeL4  ListenerMode = "l4"
+	ModeUDP ListenerMode = "l4-udp"
+)
 
-func (s *simpleServer) Serve(rw http.ResponseWriter, req *http.Request) {
-	// it will start the server on the address that we have passed in the newSimpleServer function
-	// s.proxy is getting the proxy that we have created in the newSimpleServer function
-	// then we are calling the ServeHTTP function on the proxy that we have created in the newSimpleServer function
-	// ServeHTTP  will serve the request to the server that we have passed in the newSimpleServer function
-	s.proxy.ServeHTTP(rw, req)
+// ListenerConfig describes one thing this process should listen on.
+type ListenerConfig struct {
+	Mode       ListenerMode
+	ListenAddr string
+	Backends   []string
 }
 
-func newSimpleServer(addr string) *simpleServer {
-	serverUrl, err := url.Parse(addr)
-	handleErr(err)
-
-	return &simpleServer{
-		addr:  addr,
-		proxy: httputil.NewSingleHostReverseProxy(serverUrl),
+func main() {
+	config := []ListenerConfig{
+		{
+			Mode:       ModeL7,
+			ListenAddr: ":8000",
+			Backends: []string{
+				"https://www.facebook.com",
+				"https://www.bing.com",
+				"https://www.duckduckgo.com",
+				"https://www.google.com",
+				"https://www.yahoo.com",
+			},
+		},
 	}
-}
-
-type LoadBalancer struct {
-	port            string
-	roundRobinCount int
-	servers         []Server
-}
 
-func NewLoadBalancer(port string, servers []Server) *LoadBalancer {
-	return &LoadBalancer{
-		port:            port,
-		roundRobinCount: 0,
-		servers:         servers,
+	for _, lc := range config {
+		lc := lc
+		switch lc.Mode {
+		case ModeL4, ModeUDP:
+			go runL4Listener(lc)
+		default:
+			go runL7Listener(lc)
+		}
 	}
-}
 
-func handleErr(err error) {
-	if err != nil {
-		fmt.Printf("error: %v\n", err)
-		os.Exit(1)
-	}
+	select {}
 }
 
-func (lb *LoadBalancer) getNextAvailableServer() Server {
-	// this for loop will loop through the servers slice and will return the server that is alive
-	// if the server is not alive then it will increment the roundRobinCount and will return the next server
-	server := lb.servers[lb.roundRobinCount%len(lb.servers)]
-	for !server.IsAlive() {
-		lb.roundRobinCount++
-		server = lb.servers[lb.roundRobinCount%len(lb.servers)]
+func runL7Listener(lc ListenerConfig) {
+	servers := make([]l7.Server, 0, len(lc.Backends))
+	for _, addr := range lc.Backends {
+		servers = append(servers, l7.NewSimpleServer(addr))
 	}
-	// increment the roundRobinCount so that the next time we call the getNextAvailableServer function
-	lb.roundRobinCount++
 
-	// return the server that is alive
-	return server
-}
+	policy := l7.PolicyFromName(os.Getenv("LB_POLICY"))
+	lb := l7.NewLoadBalancer(lc.ListenAddr, policy, servers)
 
-// this function is called when a request is made to the load balancer
-func (lb *LoadBalancer) serveProxy(rw http.ResponseWriter, req *http.Request) {
-	// get the next available server
-	targetServer := lb.getNextAvailableServer()
+	// Prometheus metrics are always on; they're cheap to collect and only
+	// cost anything once something scrapes /metrics on the admin port.
+	metrics := observability.NewMetrics()
+	lb.SetMetrics(metrics)
 
-	fmt.Printf("forwarding request to address %q\n", targetServer.Address())
+	// start active health checking so IsAlive() reflects real backend state
+	// instead of the "always true" placeholder this used to be
+	hc := l7.NewHealthChecker()
+	hc.SetMetrics(metrics)
+	for _, s := range servers {
+		hc.Register(s, l7.DefaultHealthCheckConfig())
+	}
+	hc.Start()
+	defer hc.Stop()
+
+	// session persistence is opt-in: set LB_PERSISTENCE=source or
+	// LB_PERSISTENCE=cookie (with LB_AFFINITY_KEY set) to stick clients to
+	// the backend their first request landed on
+	if mode := l7.PersistenceMode(os.Getenv("LB_PERSISTENCE")); mode == l7.PersistenceSource || mode == l7.PersistenceCookie {
+		lb.SetPersistence(l7.NewPersistence(mode, 5*time.Minute, []byte(os.Getenv("LB_AFFINITY_KEY")), nil))
+	}
 
-	// serve the request to the target server how ? targetserver saves the returned server from the getNextAvailableServer function
-	// and then we are calling the Serve function on the targetServer which is the server that we want to serve the request to
-	targetServer.Serve(rw, req)
+	// the admin API is bound to its own port so the hot add/remove/list
+	// endpoints can be kept off the public listener
+	adminAPI := l7.NewAdminAPI(lb, hc, l7.DefaultHealthCheckConfig())
+	adminAPI.SetMetricsHandler(metrics.Handler())
+	adminPort := os.Getenv("LB_ADMIN_PORT")
+	if adminPort == "" {
+		adminPort = "8001"
+	}
+	go func() {
+		logger.Info("serving admin api", "addr", "localhost:"+adminPort)
+		if err := http.ListenAndServe(":"+adminPort, adminAPI.Handler()); err != nil {
+			logger.Error("admin api exited", "error", err)
+			os.Exit(1)
+		}
+	}()
+
+	logger.Info("serving l7 requests", "addr", "localhost"+lc.ListenAddr)
+	if err := http.ListenAndServe(lc.ListenAddr, lb.Handler()); err != nil {
+		logger.Error("l7 listener exited", "error", err)
+		os.Exit(1)
+	}
 }
 
-func main() {
-
-	// this servers var will hold the servers that we want to load balance
-	servers := []Server{
-
-		// newSimpleServer is a helper function that returns a simpleServer struct that is saved in the servers slice
-		newSimpleServer("https://www.facebook.com"),
-		newSimpleServer("https://www.bing.com"),
-		newSimpleServer("https://www.duckduckgo.com"),
-		newSimpleServer("https://www.google.com"),
-		newSimpleServer("https://www.yahoo.com"),
+func runL4Listener(lc ListenerConfig) {
+	network := "tcp"
+	if lc.Mode == ModeUDP {
+		network = "udp"
 	}
 
-	// lb will cointain the LoadBalancer struct as we are defined it to return
-	lb := NewLoadBalancer("8000", servers)
-
-	// handelRedirect is a function that will be called when a request is made to the load balancer
-	// it is a blank function that will always call .
-
-	// then it is calling the function lb.serveProxy , as we have defined lb which contains the LoadBalancer struct
-	// then we are calling like call lb.serveProxy , how its working is lb is the receiver of the serveProxy function
-	// so lb is the receiver and serveProxy is the function that is being called on the receiver lb
-	// its like we are saving the function serveProxy in the LoadBalancer struct and then calling it when a request is made
+	proxy := l4.NewProxy(l4.Config{
+		Network:    network,
+		ListenAddr: lc.ListenAddr,
+		Backends:   lc.Backends,
+	})
 
-	handleRedirect := func(rw http.ResponseWriter, req *http.Request) {
-		lb.serveProxy(rw, req)
+	logger.Info("serving l4 requests", "network", network, "addr", "localhost"+lc.ListenAddr)
+	if err := proxy.Start(); err != nil {
+		logger.Error("l4 listener exited", "error", err)
+		os.Exit(1)
 	}
-
-	http.HandleFunc("/", handleRedirect)
-
-	fmt.Printf("serving requests at 'localhost:%s'\n", lb.port)
-	http.ListenAndServe(":"+lb.port, nil)
 }
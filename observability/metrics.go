@@ -0,0 +1,90 @@
+// Package observability instruments the load balancer with Prometheus
+// metrics. It has no dependency on l7 or l4: Metrics satisfies
+// l7.MetricsRecorder (Next() Server picking needs nothing from this
+// package) purely by implementing the same method set, so neither side
+// needs to import the other.
+package observability
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics holds the Prometheus collectors the load balancer reports into.
+type Metrics struct {
+	requestsTotal   *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	activeRequests  *prometheus.GaugeVec
+	serverUp        *prometheus.GaugeVec
+	upstreamErrors  *prometheus.CounterVec
+}
+
+// NewMetrics registers the load balancer's collectors with the default
+// Prometheus registry and returns a Metrics ready to be wired into a
+// LoadBalancer/HealthChecker via their SetMetrics methods.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requestsTotal: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "lb_requests_total",
+			Help: "Total requests proxied, by backend, method and status code.",
+		}, []string{"server", "method", "code"}),
+
+		requestDuration: promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "lb_request_duration_seconds",
+			Help:    "Upstream request latency, by backend.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"server"}),
+
+		activeRequests: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "lb_active_requests",
+			Help: "In-flight requests, by backend.",
+		}, []string{"server"}),
+
+		serverUp: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "lb_server_up",
+			Help: "1 if the backend's last health check passed, 0 otherwise.",
+		}, []string{"server"}),
+
+		upstreamErrors: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "lb_upstream_errors_total",
+			Help: "Upstream errors, by backend and reason.",
+		}, []string{"server", "reason"}),
+	}
+}
+
+// Handler serves the collected metrics in the Prometheus text exposition
+// format, for mounting at /metrics on the admin API.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// ObserveRequest records one completed proxy attempt against server.
+func (m *Metrics) ObserveRequest(server, method string, statusCode int, duration time.Duration) {
+	m.requestsTotal.WithLabelValues(server, method, strconv.Itoa(statusCode)).Inc()
+	m.requestDuration.WithLabelValues(server).Observe(duration.Seconds())
+}
+
+// ObserveUpstreamError records an attempt that failed, tagged with a short
+// reason such as "5xx" or "timeout".
+func (m *Metrics) ObserveUpstreamError(server, reason string) {
+	m.upstreamErrors.WithLabelValues(server, reason).Inc()
+}
+
+// SetActiveRequests reports a server's current in-flight request count.
+func (m *Metrics) SetActiveRequests(server string, n int32) {
+	m.activeRequests.WithLabelValues(server).Set(float64(n))
+}
+
+// SetServerUp reports a server's latest health-check result.
+func (m *Metrics) SetServerUp(server string, up bool) {
+	v := 0.0
+	if up {
+		v = 1
+	}
+	m.serverUp.WithLabelValues(server).Set(v)
+}